@@ -1,22 +1,50 @@
 package main
 
 import (
-	"bufio"
 	"ellipsis/internal/processor"
+	"ellipsis/internal/protocol"
 	"ellipsis/internal/server"
-	"fmt"
+	"flag"
+	"io"
+	"log"
 	"os"
+
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
-	processor := processor.NewProcessor(processor.Opts{
-		Server: server.NewServer(),
+	addr := flag.String("addr", "", "TCP address to listen on, e.g. :7777 (default: serve the protocol over stdio)")
+	redisAddr := flag.String("redis-addr", "", "Redis address, e.g. localhost:6379 (default: cache in-process with MemStore)")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	var store processor.CacheStore
+	if *redisAddr != "" {
+		store = processor.NewRedisStore(processor.RedisOpts{
+			Client: redis.NewClient(&redis.Options{Addr: *redisAddr}),
+		})
+	}
+
+	proc := processor.NewProcessor(processor.Opts{
+		Server: server.NewServer(server.Opts{}),
+		Logger: logger,
+		Store:  store,
+	})
+	srv := protocol.NewServer(protocol.Opts{
+		Processor: proc,
+		Logger:    logger,
 	})
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		processor.ProcessQuery(scanner.Text())
+
+	if *addr == "" {
+		srv.Serve(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout})
+		return
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "error reading stdin:", err)
+
+	if err := srv.ListenAndServe(*addr); err != nil {
+		logger.Fatal(err)
 	}
 }
@@ -0,0 +1,255 @@
+// Package itree is an augmented interval tree: a left-leaning
+// red-black tree keyed by Interval.Start, where every node also tracks
+// the maximum Interval.End in its subtree. That extra bit of state lets
+// Stab prune whole subtrees that can't possibly overlap a query instead
+// of visiting every node, giving O(log n + k) overlap queries where k
+// is the number of intervals returned.
+package itree
+
+// Interval is a half-open [Start, End) range used as a tree key.
+type Interval struct {
+	Start int64
+	End   int64
+}
+
+func (iv Interval) overlaps(start, end int64) bool {
+	return iv.Start < end && iv.End > start
+}
+
+// Entry is one (Interval, Value) pair returned by Stab.
+type Entry struct {
+	Interval Interval
+	Value    any
+}
+
+type color bool
+
+const (
+	red   color = true
+	black color = false
+)
+
+type node struct {
+	interval    Interval
+	value       any
+	max         int64
+	color       color
+	left, right *node
+}
+
+func isRed(n *node) bool {
+	return n != nil && n.color == red
+}
+
+func nodeMax(n *node) int64 {
+	if n == nil {
+		return 0
+	}
+	return n.max
+}
+
+// Tree is an interval tree keyed by Interval. The zero value is an
+// empty, ready-to-use tree.
+type Tree struct {
+	root *node
+	size int
+}
+
+// Len returns the number of intervals stored in the tree.
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// Insert adds iv with the given value, or overwrites the value if iv is
+// already present.
+func (t *Tree) Insert(iv Interval, value any) {
+	var inserted bool
+	t.root, inserted = insert(t.root, iv, value)
+	t.root.color = black
+	if inserted {
+		t.size++
+	}
+}
+
+func insert(h *node, iv Interval, value any) (*node, bool) {
+	if h == nil {
+		return &node{interval: iv, value: value, max: iv.End, color: red}, true
+	}
+
+	var inserted bool
+	switch {
+	case iv.Start < h.interval.Start, iv.Start == h.interval.Start && iv.End < h.interval.End:
+		h.left, inserted = insert(h.left, iv, value)
+	case iv.Start > h.interval.Start, iv.Start == h.interval.Start && iv.End > h.interval.End:
+		h.right, inserted = insert(h.right, iv, value)
+	default:
+		h.value = value
+		return h, false
+	}
+
+	return fixUp(h), inserted
+}
+
+// Delete removes iv from the tree, if present.
+func (t *Tree) Delete(iv Interval) {
+	if t.root == nil {
+		return
+	}
+	var deleted bool
+	t.root, deleted = delete_(t.root, iv)
+	if t.root != nil {
+		t.root.color = black
+	}
+	if deleted {
+		t.size--
+	}
+}
+
+func delete_(h *node, iv Interval) (*node, bool) {
+	var deleted bool
+	if less(iv, h.interval) {
+		if h.left == nil {
+			return h, false
+		}
+		if !isRed(h.left) && !isRed(h.left.left) {
+			h = moveRedLeft(h)
+		}
+		h.left, deleted = delete_(h.left, iv)
+	} else {
+		if isRed(h.left) {
+			h = rotateRight(h)
+		}
+		if h.interval == iv && h.right == nil {
+			return nil, true
+		}
+		if h.right == nil {
+			return h, false
+		}
+		if !isRed(h.right) && !isRed(h.right.left) {
+			h = moveRedRight(h)
+		}
+		if h.interval == iv {
+			successor := min(h.right)
+			h.interval, h.value = successor.interval, successor.value
+			h.right, deleted = deleteMin(h.right)
+		} else {
+			h.right, deleted = delete_(h.right, iv)
+		}
+	}
+	return fixUp(h), deleted
+}
+
+func deleteMin(h *node) (*node, bool) {
+	if h.left == nil {
+		return nil, true
+	}
+	if !isRed(h.left) && !isRed(h.left.left) {
+		h = moveRedLeft(h)
+	}
+	var deleted bool
+	h.left, deleted = deleteMin(h.left)
+	return fixUp(h), deleted
+}
+
+func min(h *node) *node {
+	for h.left != nil {
+		h = h.left
+	}
+	return h
+}
+
+func less(a, b Interval) bool {
+	return a.Start < b.Start || (a.Start == b.Start && a.End < b.End)
+}
+
+// Stab returns every interval in the tree that overlaps [start, end).
+func (t *Tree) Stab(start, end int64) []Entry {
+	var out []Entry
+	stab(t.root, start, end, &out)
+	return out
+}
+
+func stab(h *node, start, end int64, out *[]Entry) {
+	if h == nil || nodeMax(h) <= start {
+		return
+	}
+	stab(h.left, start, end, out)
+	if h.interval.overlaps(start, end) {
+		*out = append(*out, Entry{Interval: h.interval, Value: h.value})
+	}
+	if h.interval.Start < end {
+		stab(h.right, start, end, out)
+	}
+}
+
+func fixUp(h *node) *node {
+	if isRed(h.right) && !isRed(h.left) {
+		h = rotateLeft(h)
+	}
+	if isRed(h.left) && isRed(h.left.left) {
+		h = rotateRight(h)
+	}
+	if isRed(h.left) && isRed(h.right) {
+		flipColors(h)
+	}
+	updateMax(h)
+	return h
+}
+
+func updateMax(h *node) {
+	m := h.interval.End
+	if l := nodeMax(h.left); l > m {
+		m = l
+	}
+	if r := nodeMax(h.right); r > m {
+		m = r
+	}
+	h.max = m
+}
+
+func rotateLeft(h *node) *node {
+	x := h.right
+	h.right = x.left
+	x.left = h
+	x.color = h.color
+	h.color = red
+	updateMax(h)
+	updateMax(x)
+	return x
+}
+
+func rotateRight(h *node) *node {
+	x := h.left
+	h.left = x.right
+	x.right = h
+	x.color = h.color
+	h.color = red
+	updateMax(h)
+	updateMax(x)
+	return x
+}
+
+func flipColors(h *node) {
+	h.color = !h.color
+	h.left.color = !h.left.color
+	h.right.color = !h.right.color
+}
+
+func moveRedLeft(h *node) *node {
+	flipColors(h)
+	if isRed(h.right.left) {
+		h.right = rotateRight(h.right)
+		h = rotateLeft(h)
+		flipColors(h)
+	}
+	return h
+}
+
+func moveRedRight(h *node) *node {
+	flipColors(h)
+	if isRed(h.left.left) {
+		h = rotateRight(h)
+		flipColors(h)
+	}
+	return h
+}
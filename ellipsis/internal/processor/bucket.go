@@ -0,0 +1,300 @@
+package processor
+
+import (
+	"ellipsis/internal/itree"
+
+	dec "github.com/shopspring/decimal"
+)
+
+// resolution is a bucket width in seconds.
+type resolution int64
+
+const (
+	res1s resolution = 1
+	res1m resolution = 60
+	res1h resolution = 3600
+	res1d resolution = 86400
+)
+
+// resolutions is ordered coarsest-first so a query can greedily peel off
+// the largest aligned buckets before falling back to finer ones for the
+// ragged edges.
+var resolutions = []resolution{res1d, res1h, res1m, res1s}
+
+// retention bounds how many buckets each ring keeps before the oldest
+// slot is reused.
+var retention = map[resolution]int{
+	res1s: 3600, // last hour, at 1s
+	res1m: 1440, // last day, at 1m
+	res1h: 720,  // last 30 days, at 1h
+	res1d: 3650, // last ~10 years, at 1d
+}
+
+// Bucket holds the aggregates for one fixed-width, aligned window. A
+// zero value Bucket is "unfilled" until Filled is set, which lets a ring
+// slot be reused without a separate presence map. Not every metric uses
+// every field -- an OHLC bucket only ever sets Count/Open/High/Low/Close,
+// a VWAP bucket only Count/VWAPNum/VWAPDenom -- but one shared layout
+// keeps add and the ring/tree plumbing common to all of them.
+type Bucket struct {
+	Start  int64
+	Filled bool
+	Count  int
+	Buys   int
+	Sells  int
+	Vol    dec.Decimal
+
+	Open  dec.Decimal
+	High  dec.Decimal
+	Low   dec.Decimal
+	Close dec.Decimal
+
+	VWAPNum   dec.Decimal // Σ price*qty
+	VWAPDenom dec.Decimal // Σ qty
+}
+
+// add merges other into b in place, assuming other covers the window
+// immediately after b's (true both when a ring rolls a row of buckets up
+// into the next resolution, and when Cover's buckets and gap-derived
+// sub-buckets are walked in Query order). Count/Buys/Sells/Vol/VWAP are
+// additive; Open/High/Low/Close are not -- open is whichever side saw a
+// trade first, close is whichever saw one last, and high/low widen, so a
+// bucket with no trades (Count == 0) must leave them untouched rather
+// than merging in its zero values.
+func (b *Bucket) add(other Bucket) {
+	hadTrades := b.Count > 0
+	otherHasTrades := other.Count > 0
+
+	b.Count += other.Count
+	b.Buys += other.Buys
+	b.Sells += other.Sells
+	b.Vol = b.Vol.Add(other.Vol)
+	b.VWAPNum = b.VWAPNum.Add(other.VWAPNum)
+	b.VWAPDenom = b.VWAPDenom.Add(other.VWAPDenom)
+
+	if !otherHasTrades {
+		return
+	}
+	if !hadTrades {
+		b.Open = other.Open
+		b.High = other.High
+		b.Low = other.Low
+	} else {
+		if other.High.GreaterThan(b.High) {
+			b.High = other.High
+		}
+		if other.Low.LessThan(b.Low) {
+			b.Low = other.Low
+		}
+	}
+	b.Close = other.Close
+}
+
+// ring is a round-robin array of buckets at a single resolution.
+type ring struct {
+	res   resolution
+	slots []Bucket
+}
+
+func newRing(res resolution) *ring {
+	return &ring{res: res, slots: make([]Bucket, retention[res])}
+}
+
+func (r *ring) index(start int64) int {
+	return int((start / int64(r.res)) % int64(len(r.slots)))
+}
+
+func (r *ring) get(start int64) (Bucket, bool) {
+	b := r.slots[r.index(start)]
+	if !b.Filled || b.Start != start {
+		return Bucket{}, false
+	}
+	return b, true
+}
+
+// row recomputes the coarser-resolution bucket for [coarseStart,
+// coarseStart+step) by reading every child slot in that window directly,
+// reporting ok=false if any child is missing or stale (not yet fetched,
+// or evicted by ring wraparound). Reading straight from the slots rather
+// than keeping a running accumulator makes the roll-up idempotent: a
+// child window fed twice (e.g. two connections racing the same cache
+// miss) just overwrites its slot in place, and the next row covering it
+// recomputes from the corrected state instead of double-counting.
+func (r *ring) row(coarseStart, step int64) (Bucket, bool) {
+	var row Bucket
+	row.Start = coarseStart
+	row.Filled = true
+	for childStart := coarseStart; childStart < coarseStart+step; childStart += int64(r.res) {
+		b, ok := r.get(childStart)
+		if !ok {
+			return Bucket{}, false
+		}
+		row.add(b)
+	}
+	return row, true
+}
+
+// RingCache is a multi-resolution, round-robin bucket store for a single
+// metric (count, buys, sells, vol, OHLC, or VWAP). Buckets never overlap, so a query
+// is answered by peeling off the coarsest cached buckets that fit and
+// falling back to finer ones at the edges, with no stale-interval
+// subtraction. Which bucket intervals are currently filled, across all
+// resolutions, is tracked in an itree.Tree so lookups don't need to
+// probe every ring.
+type RingCache struct {
+	rings map[resolution]*ring
+	tree  *itree.Tree
+}
+
+func newRingCache() *RingCache {
+	rc := &RingCache{rings: make(map[resolution]*ring, len(resolutions)), tree: &itree.Tree{}}
+	for _, res := range resolutions {
+		rc.rings[res] = newRing(res)
+	}
+	return rc
+}
+
+// Cover returns every cached bucket fully inside [start, end) along with
+// the gaps no bucket covers, preferring the coarsest resolution at each
+// step. A single Stab over the whole range fetches every candidate
+// interval up front -- O(log n + k) -- so the walk below only has to
+// step from cached interval to cached interval, rather than re-probing
+// the tree one second at a time, which would make a wide cold query cost
+// O(range) regardless of how few intervals actually cover it.
+func (rc *RingCache) Cover(start, end int64) ([]Bucket, []interval) {
+	entries := rc.tree.Stab(start, end) // ascending by Start (in-order walk)
+
+	var buckets []Bucket
+	var gaps []interval
+
+	cur := start
+	i := 0
+	for cur < end {
+		for i < len(entries) && entries[i].Interval.Start < cur {
+			i++
+		}
+
+		var bestRes resolution
+		found := false
+		j := i
+		for j < len(entries) && entries[j].Interval.Start == cur {
+			if entries[j].Interval.End <= end {
+				if res := entries[j].Value.(resolution); !found || res > bestRes {
+					bestRes, found = res, true
+				}
+			}
+			j++
+		}
+
+		if found {
+			if b, ok := rc.rings[bestRes].get(cur); ok {
+				buckets = append(buckets, b)
+				cur += int64(bestRes)
+				i = j
+				continue
+			}
+		}
+
+		gapStart := cur
+		gapEnd := end
+		if j < len(entries) {
+			gapEnd = entries[j].Interval.Start
+		}
+		if n := len(gaps); n > 0 && gaps[n-1].end == gapStart {
+			gaps[n-1].end = gapEnd
+		} else {
+			gaps = append(gaps, interval{start: gapStart, end: gapEnd})
+		}
+		cur, i = gapEnd, j
+	}
+
+	return buckets, gaps
+}
+
+// Overlapping returns every cached bucket interval, at any resolution,
+// that overlaps [start, end).
+func (rc *RingCache) Overlapping(start, end int64) []itree.Entry {
+	return rc.tree.Stab(start, end)
+}
+
+// Delete removes the cached bucket at iv, if present.
+func (rc *RingCache) Delete(iv interval) {
+	res := resolution(iv.end - iv.start)
+	r, ok := rc.rings[res]
+	if !ok {
+		return
+	}
+	idx := r.index(iv.start)
+	if b := r.slots[idx]; b.Filled && b.Start == iv.start {
+		r.slots[idx] = Bucket{}
+		rc.tree.Delete(itree.Interval{Start: iv.start, End: iv.end})
+	}
+}
+
+// Put stores a freshly-fetched bucket. Its width must be exactly one of
+// the ring resolutions; segmentAligned only ever produces such widths.
+func (rc *RingCache) Put(iv interval, b Bucket) {
+	res := resolution(iv.end - iv.start)
+	if _, ok := rc.rings[res]; !ok {
+		return
+	}
+	rc.feed(res, b)
+}
+
+// feed writes b into its ring (indexing it in the tree, and evicting
+// whatever the ring slot held before), then checks whether every child
+// slot of the next coarser window is now filled. If so it recomputes
+// that window's bucket straight from the slots and feeds it up a tier.
+// This is how a 1s ring ages into 1m, 1m into 1h, and 1h into 1d.
+func (rc *RingCache) feed(res resolution, b Bucket) {
+	r := rc.rings[res]
+	idx := r.index(b.Start)
+	evicted := r.slots[idx]
+	if evicted.Filled && evicted.Start != b.Start {
+		rc.tree.Delete(itree.Interval{Start: evicted.Start, End: evicted.Start + int64(res)})
+	}
+	r.slots[idx] = b
+	rc.tree.Insert(itree.Interval{Start: b.Start, End: b.Start + int64(res)}, res)
+
+	parent := coarserOf(res)
+	if parent == 0 {
+		return
+	}
+
+	step := int64(parent)
+	coarseStart := (b.Start / step) * step
+	if row, ok := r.row(coarseStart, step); ok {
+		rc.feed(parent, row)
+	}
+}
+
+// coarserOf returns the next coarser resolution, or 0 if res is already
+// the coarsest.
+func coarserOf(res resolution) resolution {
+	for i, r := range resolutions {
+		if r == res && i > 0 {
+			return resolutions[i-1]
+		}
+	}
+	return 0
+}
+
+// segmentAligned splits [start, end) into the fewest coarsest-first
+// aligned chunks, falling back to 1s width for any unaligned remainder.
+func segmentAligned(start, end int64) []interval {
+	var out []interval
+	cur := start
+	for cur < end {
+		step := int64(res1s)
+		for _, res := range resolutions {
+			s := int64(res)
+			if cur%s == 0 && cur+s <= end {
+				step = s
+				break
+			}
+		}
+		out = append(out, interval{start: cur, end: cur + step})
+		cur += step
+	}
+	return out
+}
@@ -3,9 +3,9 @@ package processor
 import (
 	"ellipsis/internal/server"
 	"fmt"
-	"sort"
+	"io"
+	"log"
 	"strconv"
-	"strings"
 
 	dec "github.com/shopspring/decimal"
 )
@@ -16,20 +16,58 @@ type setFlag struct{}
 
 var exists = setFlag{}
 
-type queryType int
+// QueryType identifies which aggregate a Query asks for.
+type QueryType int
 
 const (
-	count queryType = iota
-	buys
-	sells
-	vol
+	Count QueryType = iota
+	Buys
+	Sells
+	Vol
+	OHLC
+	VWAP
+	// Last has no cache of its own -- it reuses OHLC's, since an OHLC
+	// bucket's Close is already "the last trade price in the window".
+	Last
 )
 
-var queryTypeMap = map[rune]queryType{
-	'C': count,
-	'B': buys,
-	'S': sells,
-	'V': vol,
+var queryTypeMap = map[rune]QueryType{
+	'C': Count,
+	'B': Buys,
+	'S': Sells,
+	'V': Vol,
+	'O': OHLC,
+	'W': VWAP,
+	'L': Last,
+}
+
+// ParseQueryType maps a single-letter query-type code, as used by both
+// the text protocol and the CLI, to a QueryType.
+func ParseQueryType(code string) (QueryType, error) {
+	if len(code) != 1 {
+		return 0, fmt.Errorf("invalid query type of len %d: %s", len(code), code)
+	}
+	qt, ok := queryTypeMap[rune(code[0])]
+	if !ok {
+		return 0, fmt.Errorf("invalid query type: %s", code)
+	}
+	return qt, nil
+}
+
+// Query is a single aggregate request over the half-open-on-the-left
+// window (Start, End]. It is the one representation shared by every
+// caller of Execute, whether that's the text protocol server or a
+// direct in-process call.
+type Query struct {
+	Type  QueryType
+	Start int64
+	End   int64
+}
+
+// Result is the answer to a Query, already formatted the way the text
+// protocol puts it on the wire.
+type Result struct {
+	Value string
 }
 
 type interval struct {
@@ -37,287 +75,297 @@ type interval struct {
 	end   int64
 }
 
-type cache struct {
-	countCache map[interval]int
-	buysCache  map[interval]int
-	sellsCache map[interval]int
-	volCache   map[interval]dec.Decimal
-}
-
 type Processor struct {
 	server *server.Server
-	cache  *cache
+	logger *log.Logger
+	store  CacheStore
 }
 
 type Opts struct {
 	Server *server.Server
+	Logger *log.Logger
+	// Store is the cache backend. Defaults to an in-memory MemStore.
+	Store CacheStore
 }
 
 func NewProcessor(opts Opts) *Processor {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	store := opts.Store
+	if store == nil {
+		store = NewMemStore()
+	}
 	return &Processor{
 		server: opts.Server,
-		cache: &cache{
-			countCache: make(map[interval]int),
-			buysCache:  make(map[interval]int),
-			sellsCache: make(map[interval]int),
-			volCache:   make(map[interval]dec.Decimal),
-		},
+		logger: logger,
+		store:  store,
 	}
 }
 
-func (p *Processor) ProcessQuery(query string) error {
-	queryType, startTsInSeconds, endTsInSeconds, err := p.parseQuery(query)
-	if err != nil {
-		return fmt.Errorf("failed to parse query: %w", err)
+// Execute answers q, fetching whatever isn't already cached.
+func (p *Processor) Execute(q Query) (Result, error) {
+	if q.End < q.Start {
+		return Result{}, fmt.Errorf("invalid query: end %d before start %d", q.End, q.Start)
+	}
+
+	// Last rides on OHLC's cache, so it covers intervals as OHLC too.
+	storeType := q.Type
+	if storeType == Last {
+		storeType = OHLC
 	}
-	cacheHitIntervals, queryIntervals, staleIntervals := p.processIntervals(*queryType, *startTsInSeconds, *endTsInSeconds)
-	fmt.Println("type:", query[:1], "start:", *startTsInSeconds, "end:", *endTsInSeconds)
-	fmt.Println("hit:", cacheHitIntervals, "query:", queryIntervals, "stale:", staleIntervals)
-
-	switch *queryType {
-	case count:
-		p.processCount(cacheHitIntervals, queryIntervals, staleIntervals)
-	case buys:
-		p.processBuys(cacheHitIntervals, queryIntervals, staleIntervals)
-	case sells:
-		p.processSells(cacheHitIntervals, queryIntervals, staleIntervals)
-	case vol:
-		p.processVol(cacheHitIntervals, queryIntervals, staleIntervals)
+
+	buckets, gaps := p.processIntervals(storeType, q.Start, q.End)
+	p.logger.Println("type:", q.Type, "start:", q.Start, "end:", q.End)
+	p.logger.Println("buckets:", len(buckets), "gaps:", gaps)
+
+	var value string
+	switch q.Type {
+	case Count:
+		value = strconv.Itoa(p.processCount(buckets, gaps))
+	case Buys:
+		value = strconv.Itoa(p.processBuys(buckets, gaps))
+	case Sells:
+		value = strconv.Itoa(p.processSells(buckets, gaps))
+	case Vol:
+		value = p.processVol(buckets, gaps).String()
+	case OHLC:
+		bar := p.processOHLC(buckets, gaps)
+		value = fmt.Sprintf("%s,%s,%s,%s", bar.Open, bar.High, bar.Low, bar.Close)
+	case VWAP:
+		value = p.processVWAP(buckets, gaps).String()
+	case Last:
+		value = p.processOHLC(buckets, gaps).Close.String()
+	default:
+		return Result{}, fmt.Errorf("invalid query type: %d", q.Type)
 	}
 
-	return nil
+	return Result{Value: value}, nil
 }
 
+// processIntervals returns the cached buckets covering as much of
+// (startTsInSeconds, endTsInSeconds] as possible, plus the gaps that
+// still need to be fetched from the server.
 func (p *Processor) processIntervals(
-	qt queryType,
+	qt QueryType,
 	startTsInSeconds int64,
 	endTsInSeconds int64,
-) ([]interval, []interval, []interval) {
-	var cacheIntervals, queryIntervals []interval
-	switch qt {
-	case count:
-		for k := range p.cache.countCache {
-			cacheIntervals = append(cacheIntervals, k)
-		}
-	case buys:
-		for k := range p.cache.buysCache {
-			cacheIntervals = append(cacheIntervals, k)
-		}
-	case sells:
-		for k := range p.cache.sellsCache {
-			cacheIntervals = append(cacheIntervals, k)
-		}
-	case vol:
-		for k := range p.cache.volCache {
-			cacheIntervals = append(cacheIntervals, k)
-		}
-	}
-
-	var cacheHitIntervals []interval
-	for _, cacheInterval := range cacheIntervals {
-		if (cacheInterval.start < startTsInSeconds && cacheInterval.end <= endTsInSeconds) ||
-			(cacheInterval.start >= endTsInSeconds && cacheInterval.end > endTsInSeconds) {
-			continue
-		}
-		cacheHitIntervals = append(cacheHitIntervals, cacheInterval)
-	}
-
-	sort.Slice(cacheHitIntervals, func(i, j int) bool {
-		return cacheHitIntervals[i].start < cacheHitIntervals[j].start
-	})
-
-	var last int64 = startTsInSeconds
-	var staleIntervals []interval
-	for _, cacheHit := range cacheHitIntervals {
-		if cacheHit.start < startTsInSeconds && cacheHit.end > endTsInSeconds {
-			staleIntervals = append(staleIntervals, cacheHit)
-			cacheHitIntervals = cacheHitIntervals[1:]
-			break
-		}
-		if cacheHit.start < startTsInSeconds {
-			staleIntervals = append(staleIntervals, cacheHit)
-			queryIntervals = append(queryIntervals, interval{start: startTsInSeconds, end: cacheHit.end})
-			cacheHitIntervals = cacheHitIntervals[1:]
-			last = cacheHit.end
-			continue
-		}
-		if cacheHit.end > endTsInSeconds {
-			staleIntervals = append(staleIntervals, cacheHit)
-			if cacheHit.start > last {
-				queryIntervals = append(queryIntervals, interval{start: last, end: cacheHit.start})
-			}
-			cacheHitIntervals = cacheHitIntervals[:len(cacheHitIntervals)-1]
-			last = cacheHit.start
-			continue
-		}
-		if cacheHit.start > last {
-			queryIntervals = append(queryIntervals, interval{start: last, end: cacheHit.start})
-		}
-		last = cacheHit.end
-	}
-
-	if last < endTsInSeconds {
-		queryIntervals = append(queryIntervals, interval{start: last, end: endTsInSeconds})
-	}
-	if len(queryIntervals) == 0 && len(cacheHitIntervals) == 0 {
-		queryIntervals = append(queryIntervals, interval{start: startTsInSeconds, end: endTsInSeconds})
-	}
+) ([]Bucket, []interval) {
+	return p.store.Cover(qt, startTsInSeconds, endTsInSeconds)
+}
 
-	return cacheHitIntervals, queryIntervals, staleIntervals
+// fillInInterval reports whether fill.Time falls in (iv.start, iv.end],
+// matching the half-open-on-the-left convention server.GetFillsAPI uses.
+func fillInInterval(fill *server.Fill, iv interval) bool {
+	ts := fill.Time.Unix()
+	return ts > iv.start && ts <= iv.end
 }
 
-func (p *Processor) processCount(cacheHitIntervals, queryIntervals, staleIntervals []interval) {
+func (p *Processor) processCount(buckets []Bucket, gaps []interval) int {
 	var totalCount int
-	for _, interval := range cacheHitIntervals {
-		totalCount += p.cache.countCache[interval]
+	for _, b := range buckets {
+		totalCount += b.Count
 	}
 
-	for _, interval := range queryIntervals {
-		fills := p.server.GetFillsAPI(interval.start, interval.end)
-		seen := make(map[uint64]struct{})
-		for _, fill := range fills {
-			if _, ok := seen[fill.SequenceNumber]; !ok {
-				seen[fill.SequenceNumber] = exists
-				totalCount++
+	for _, gap := range gaps {
+		fills := p.server.GetFillsAPI(gap.start, gap.end)
+		for _, sub := range segmentAligned(gap.start, gap.end) {
+			seen := make(map[uint64]struct{})
+			var subCount int
+			for _, fill := range fills {
+				if !fillInInterval(fill, sub) {
+					continue
+				}
+				if _, ok := seen[fill.SequenceNumber]; !ok {
+					seen[fill.SequenceNumber] = exists
+					subCount++
+				}
 			}
+			totalCount += subCount
+			p.store.Put(Count, sub, Bucket{Start: sub.start, Filled: true, Count: subCount})
 		}
-		p.updateCache(count, interval, &totalCount, nil, staleIntervals)
 	}
 
-	fmt.Println(totalCount)
+	return totalCount
 }
 
-func (p *Processor) processBuys(cacheHitIntervals, queryIntervals, staleIntervals []interval) {
+func (p *Processor) processBuys(buckets []Bucket, gaps []interval) int {
 	var totalBuys int
-	for _, interval := range cacheHitIntervals {
-		totalBuys += p.cache.buysCache[interval]
+	for _, b := range buckets {
+		totalBuys += b.Buys
 	}
 
-	fmt.Println(totalBuys)
-
-	for _, interval := range queryIntervals {
-		fills := p.server.GetFillsAPI(interval.start, interval.end)
-		seen := make(set)
-		for _, fill := range fills {
-			if _, ok := seen[fill.SequenceNumber]; !ok && fill.Direction > 0 {
-				seen[fill.SequenceNumber] = exists
-				totalBuys++
+	for _, gap := range gaps {
+		fills := p.server.GetFillsAPI(gap.start, gap.end)
+		for _, sub := range segmentAligned(gap.start, gap.end) {
+			seen := make(set)
+			var subBuys int
+			for _, fill := range fills {
+				if !fillInInterval(fill, sub) {
+					continue
+				}
+				if _, ok := seen[fill.SequenceNumber]; !ok && fill.Direction > 0 {
+					seen[fill.SequenceNumber] = exists
+					subBuys++
+				}
 			}
+			totalBuys += subBuys
+			p.store.Put(Buys, sub, Bucket{Start: sub.start, Filled: true, Buys: subBuys})
 		}
-		p.updateCache(buys, interval, &totalBuys, nil, staleIntervals)
-		fmt.Println(totalBuys)
 	}
 
-	fmt.Println(totalBuys)
+	return totalBuys
 }
 
-func (p *Processor) processSells(cacheHitIntervals, queryIntervals, staleIntervals []interval) {
+func (p *Processor) processSells(buckets []Bucket, gaps []interval) int {
 	var totalSells int
-	for _, interval := range cacheHitIntervals {
-		totalSells += p.cache.sellsCache[interval]
+	for _, b := range buckets {
+		totalSells += b.Sells
 	}
 
-	for _, interval := range queryIntervals {
-		fills := p.server.GetFillsAPI(interval.start, interval.end)
-		seen := make(map[uint64]struct{})
-		for _, fill := range fills {
-			if _, ok := seen[fill.SequenceNumber]; !ok && fill.Direction < 0 {
-				seen[fill.SequenceNumber] = exists
-				totalSells++
+	for _, gap := range gaps {
+		fills := p.server.GetFillsAPI(gap.start, gap.end)
+		for _, sub := range segmentAligned(gap.start, gap.end) {
+			seen := make(map[uint64]struct{})
+			var subSells int
+			for _, fill := range fills {
+				if !fillInInterval(fill, sub) {
+					continue
+				}
+				if _, ok := seen[fill.SequenceNumber]; !ok && fill.Direction < 0 {
+					seen[fill.SequenceNumber] = exists
+					subSells++
+				}
 			}
+			totalSells += subSells
+			p.store.Put(Sells, sub, Bucket{Start: sub.start, Filled: true, Sells: subSells})
 		}
-		p.updateCache(sells, interval, &totalSells, nil, staleIntervals)
 	}
 
-	fmt.Println(totalSells)
+	return totalSells
 }
 
-func (p *Processor) processVol(cacheHitIntervals, queryIntervals, staleIntervals []interval) {
+func (p *Processor) processVol(buckets []Bucket, gaps []interval) dec.Decimal {
 	var totalVol dec.Decimal
-	for _, interval := range cacheHitIntervals {
-		totalVol = totalVol.Add(p.cache.volCache[interval])
+	for _, b := range buckets {
+		totalVol = totalVol.Add(b.Vol)
 	}
 
-	for _, interval := range queryIntervals {
-		fills := p.server.GetFillsAPI(interval.start, interval.end)
-		for _, fill := range fills {
-			totalVol = totalVol.Add(fill.Price.Mul(fill.Quantity))
+	for _, gap := range gaps {
+		fills := p.server.GetFillsAPI(gap.start, gap.end)
+		for _, sub := range segmentAligned(gap.start, gap.end) {
+			var subVol dec.Decimal
+			for _, fill := range fills {
+				if !fillInInterval(fill, sub) {
+					continue
+				}
+				subVol = subVol.Add(fill.Price.Mul(fill.Quantity))
+			}
+			totalVol = totalVol.Add(subVol)
+			p.store.Put(Vol, sub, Bucket{Start: sub.start, Filled: true, Vol: subVol})
 		}
-		p.updateCache(vol, interval, nil, &totalVol, staleIntervals)
 	}
 
-	fmt.Println(totalVol)
+	return totalVol
 }
 
-func (p *Processor) parseQuery(query string) (*queryType, *int64, *int64, error) {
-	fields := strings.Fields(query)
-	if len(fields) != 3 {
-		return nil, nil, nil, fmt.Errorf("invalid query witn %d fields: %s", len(fields), query)
-	}
+// processOHLC returns the merged open/high/low/close bar for buckets plus
+// gaps, fetching and caching one OHLC bucket per aligned sub-interval of
+// each gap. Fills within a sub-interval are assumed to arrive in
+// chronological order, as server.GetFillsAPI returns them, so the first
+// one sets Open and the last one sets Close.
+func (p *Processor) processOHLC(buckets []Bucket, gaps []interval) Bucket {
+	return p.mergeOrdered(OHLC, buckets, gaps, ohlcBucketFor)
+}
 
-	if len(fields[0]) != 1 {
-		return nil, nil, nil, fmt.Errorf("invalid query type of len %d: %s", len(fields[0]), fields[0])
-	}
-	queryType, ok := queryTypeMap[rune(fields[0][0])]
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("invalid query type: %s", fields[0])
-	}
-	startTsInSeconds, err := strconv.ParseInt(fields[1], 10, 64)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("invalid start timestamp: %s", fields[1])
-	}
-	endTsInSeconds, err := strconv.ParseInt(fields[2], 10, 64)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("invalid end timestamp: %s", fields[2])
+func ohlcBucketFor(fills []*server.Fill, sub interval) Bucket {
+	var b Bucket
+	for _, fill := range fills {
+		if !fillInInterval(fill, sub) {
+			continue
+		}
+		if b.Count == 0 {
+			b.Open = fill.Price
+			b.High = fill.Price
+			b.Low = fill.Price
+		} else {
+			if fill.Price.GreaterThan(b.High) {
+				b.High = fill.Price
+			}
+			if fill.Price.LessThan(b.Low) {
+				b.Low = fill.Price
+			}
+		}
+		b.Close = fill.Price
+		b.Count++
 	}
+	b.Start = sub.start
+	b.Filled = true
+	return b
+}
 
-	return &queryType, &startTsInSeconds, &endTsInSeconds, nil
+// processVWAP returns the volume-weighted average price over buckets
+// plus gaps, fetching and caching one VWAP bucket per aligned
+// sub-interval of each gap. Numerator and denominator are cached
+// separately so two adjacent windows merge exactly via
+// (n1+n2)/(d1+d2) instead of averaging already-averaged prices.
+func (p *Processor) processVWAP(buckets []Bucket, gaps []interval) dec.Decimal {
+	total := p.mergeOrdered(VWAP, buckets, gaps, vwapBucketFor)
+	if total.VWAPDenom.IsZero() {
+		return dec.Decimal{}
+	}
+	return total.VWAPNum.Div(total.VWAPDenom)
 }
 
-func (p *Processor) updateCache(
-	qt queryType,
-	newInterval interval,
-	totalInt *int,
-	totalDec *dec.Decimal,
-	staleIntervals []interval,
-) {
-	for _, stale := range staleIntervals {
-		var refreshInterval interval
-		if stale.start < newInterval.start && stale.end > newInterval.end {
-			delete(p.cache.countCache, stale)
-			break
-		} else if stale.start < newInterval.start && stale.end == newInterval.end {
-			refreshInterval = interval{start: stale.start, end: newInterval.start}
-		} else if stale.start == newInterval.start && stale.end > newInterval.end {
-			refreshInterval = interval{start: newInterval.end, end: stale.end}
-		} else {
+func vwapBucketFor(fills []*server.Fill, sub interval) Bucket {
+	var b Bucket
+	for _, fill := range fills {
+		if !fillInInterval(fill, sub) {
 			continue
 		}
+		b.VWAPNum = b.VWAPNum.Add(fill.Price.Mul(fill.Quantity))
+		b.VWAPDenom = b.VWAPDenom.Add(fill.Quantity)
+		b.Count++
+	}
+	b.Start = sub.start
+	b.Filled = true
+	return b
+}
 
-		switch qt {
-		case count:
-			p.cache.countCache[refreshInterval] = p.cache.countCache[stale] - *totalInt
-			delete(p.cache.countCache, stale)
-		case buys:
-			p.cache.buysCache[refreshInterval] = p.cache.buysCache[stale] - *totalInt
-			delete(p.cache.buysCache, stale)
-		case sells:
-			p.cache.sellsCache[refreshInterval] = p.cache.sellsCache[stale] - *totalInt
-			delete(p.cache.sellsCache, stale)
-		case vol:
-			p.cache.volCache[refreshInterval] = p.cache.volCache[stale].Sub(*totalDec)
-			delete(p.cache.volCache, stale)
+// mergeOrdered folds buckets and the gap-derived sub-buckets compute
+// produces into one running total, walking both in ascending Start
+// order. Cover hands back buckets and gaps as two separate slices, but
+// OHLC/VWAP's Open/Close are order-sensitive (unlike the additive
+// count/buys/sells/vol totals), so they can't be folded in two separate
+// passes the way processCount et al. are -- a gap before the first
+// cached bucket would otherwise get merged in after it.
+func (p *Processor) mergeOrdered(
+	metric QueryType,
+	buckets []Bucket,
+	gaps []interval,
+	compute func([]*server.Fill, interval) Bucket,
+) Bucket {
+	var total Bucket
+	bi := 0
+
+	for _, gap := range gaps {
+		fills := p.server.GetFillsAPI(gap.start, gap.end)
+		for _, sub := range segmentAligned(gap.start, gap.end) {
+			for bi < len(buckets) && buckets[bi].Start < sub.start {
+				total.add(buckets[bi])
+				bi++
+			}
+
+			subBucket := compute(fills, sub)
+			total.add(subBucket)
+			p.store.Put(metric, sub, subBucket)
 		}
 	}
 
-	switch qt {
-	case count:
-		p.cache.countCache[newInterval] = *totalInt
-	case buys:
-		p.cache.buysCache[newInterval] = *totalInt
-	case sells:
-		p.cache.sellsCache[newInterval] = *totalInt
-	case vol:
-		p.cache.volCache[newInterval] = *totalDec
+	for ; bi < len(buckets); bi++ {
+		total.add(buckets[bi])
 	}
+
+	return total
 }
@@ -0,0 +1,248 @@
+package processor
+
+import (
+	"context"
+	"ellipsis/internal/itree"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	dec "github.com/shopspring/decimal"
+)
+
+// RedisStore is a CacheStore backed by Redis: each metric's buckets
+// live in one sorted set keyed by metric, scored by bucket start, with
+// the bucket's width and aggregates packed into the member payload.
+// That makes overlap queries a ZRANGEBYSCORE and lets multiple
+// Processor instances share cached windows across processes and
+// survive restarts.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+type RedisOpts struct {
+	Client *redis.Client
+	// Prefix namespaces the sorted sets. Defaults to "ellipsis:".
+	Prefix string
+}
+
+func NewRedisStore(opts RedisOpts) *RedisStore {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "ellipsis:"
+	}
+	return &RedisStore{client: opts.Client, prefix: prefix}
+}
+
+func (r *RedisStore) key(metric QueryType) string {
+	return r.prefix + metricName(metric)
+}
+
+func metricName(qt QueryType) string {
+	switch qt {
+	case Count:
+		return "count"
+	case Buys:
+		return "buys"
+	case Sells:
+		return "sells"
+	case Vol:
+		return "vol"
+	case OHLC:
+		return "ohlc"
+	case VWAP:
+		return "vwap"
+	default:
+		return "unknown"
+	}
+}
+
+// encodeBucket packs a bucket and its width into a sorted-set member.
+func encodeBucket(b Bucket, width int64) string {
+	return fmt.Sprintf("%d|%d|%d|%d|%d|%s|%s|%s|%s|%s|%s|%s",
+		b.Start, width, b.Count, b.Buys, b.Sells, b.Vol.String(),
+		b.Open.String(), b.High.String(), b.Low.String(), b.Close.String(),
+		b.VWAPNum.String(), b.VWAPDenom.String())
+}
+
+func decodeBucket(member string) (b Bucket, width int64, ok bool) {
+	parts := strings.Split(member, "|")
+	if len(parts) != 12 {
+		return Bucket{}, 0, false
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	width, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	count, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	buys, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	sells, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	vol, err := dec.NewFromString(parts[5])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	open, err := dec.NewFromString(parts[6])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	high, err := dec.NewFromString(parts[7])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	low, err := dec.NewFromString(parts[8])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	close, err := dec.NewFromString(parts[9])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	vwapNum, err := dec.NewFromString(parts[10])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+	vwapDenom, err := dec.NewFromString(parts[11])
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+
+	return Bucket{
+		Start: start, Filled: true, Count: count, Buys: buys, Sells: sells, Vol: vol,
+		Open: open, High: high, Low: low, Close: close,
+		VWAPNum: vwapNum, VWAPDenom: vwapDenom,
+	}, width, true
+}
+
+func (r *RedisStore) membersAt(metric QueryType, start int64) ([]string, error) {
+	score := strconv.FormatInt(start, 10)
+	return r.client.ZRangeByScore(context.Background(), r.key(metric), &redis.ZRangeBy{
+		Min: score,
+		Max: score,
+	}).Result()
+}
+
+func (r *RedisStore) Get(metric QueryType, start, width int64) (Bucket, bool) {
+	members, err := r.membersAt(metric, start)
+	if err != nil {
+		return Bucket{}, false
+	}
+	for _, m := range members {
+		if b, w, ok := decodeBucket(m); ok && w == width {
+			return b, true
+		}
+	}
+	return Bucket{}, false
+}
+
+func (r *RedisStore) Put(metric QueryType, iv interval, b Bucket) {
+	width := iv.end - iv.start
+	r.Delete(metric, iv)
+	r.client.ZAdd(context.Background(), r.key(metric), redis.Z{
+		Score:  float64(b.Start),
+		Member: encodeBucket(b, width),
+	})
+}
+
+func (r *RedisStore) Delete(metric QueryType, iv interval) {
+	width := iv.end - iv.start
+	members, err := r.membersAt(metric, iv.start)
+	if err != nil {
+		return
+	}
+	for _, m := range members {
+		if _, w, ok := decodeBucket(m); ok && w == width {
+			r.client.ZRem(context.Background(), r.key(metric), m)
+		}
+	}
+}
+
+// Cover mirrors RingCache.Cover's greedy, coarsest-first walk, but
+// fetches candidate buckets one ZRANGEBYSCORE at a time instead of
+// consulting an in-process itree.
+func (r *RedisStore) Cover(metric QueryType, start, end int64) ([]Bucket, []interval) {
+	var buckets []Bucket
+	var gaps []interval
+
+	cur := start
+	for cur < end {
+		if b, width, ok := r.bestBucketAt(metric, cur, end); ok {
+			buckets = append(buckets, b)
+			cur += width
+			continue
+		}
+
+		gapStart := cur
+		cur++
+		if n := len(gaps); n > 0 && gaps[n-1].end == gapStart {
+			gaps[n-1].end = cur
+		} else {
+			gaps = append(gaps, interval{start: gapStart, end: cur})
+		}
+	}
+
+	return buckets, gaps
+}
+
+func (r *RedisStore) bestBucketAt(metric QueryType, cur, end int64) (Bucket, int64, bool) {
+	members, err := r.membersAt(metric, cur)
+	if err != nil {
+		return Bucket{}, 0, false
+	}
+
+	var best Bucket
+	var bestWidth int64
+	found := false
+	for _, m := range members {
+		b, width, ok := decodeBucket(m)
+		if !ok || cur+width > end {
+			continue
+		}
+		if !found || width > bestWidth {
+			best, bestWidth, found = b, width, true
+		}
+	}
+	return best, bestWidth, found
+}
+
+// Overlapping scans the sorted set for every bucket starting in
+// [start-res1d, end) -- res1d, the coarsest resolution, is the furthest
+// a bucket can start before start and still reach into the query -- and
+// filters down to the ones that actually overlap.
+func (r *RedisStore) Overlapping(metric QueryType, start, end int64) []itree.Entry {
+	members, err := r.client.ZRangeByScore(context.Background(), r.key(metric), &redis.ZRangeBy{
+		Min: strconv.FormatInt(start-int64(res1d), 10),
+		Max: strconv.FormatInt(end, 10),
+	}).Result()
+	if err != nil {
+		return nil
+	}
+
+	var out []itree.Entry
+	for _, m := range members {
+		b, width, ok := decodeBucket(m)
+		if !ok {
+			continue
+		}
+		iv := itree.Interval{Start: b.Start, End: b.Start + width}
+		if iv.Start < end && iv.End > start {
+			out = append(out, itree.Entry{Interval: iv, Value: resolution(width)})
+		}
+	}
+	return out
+}
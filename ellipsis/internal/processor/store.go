@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"ellipsis/internal/itree"
+	"sync"
+)
+
+// CacheStore is the pluggable backend behind Processor's cache. One
+// CacheStore holds cached buckets for every metric, tagged by
+// QueryType, so a Processor can run against an in-process cache or one
+// backed by an external store like Redis without the query logic
+// changing.
+type CacheStore interface {
+	// Get returns the cached bucket for the aligned window
+	// [start, start+width) of metric, if present.
+	Get(metric QueryType, start, width int64) (Bucket, bool)
+	// Put stores a freshly-computed bucket for metric.
+	Put(metric QueryType, iv interval, b Bucket)
+	// Cover returns the cached buckets of metric covering as much of
+	// [start, end) as possible, plus the remaining gaps.
+	Cover(metric QueryType, start, end int64) ([]Bucket, []interval)
+	// Overlapping returns every cached bucket interval of metric, at
+	// any resolution, that overlaps [start, end).
+	Overlapping(metric QueryType, start, end int64) []itree.Entry
+	// Delete removes the cached bucket for metric at iv, if present.
+	Delete(metric QueryType, iv interval)
+}
+
+// MemStore is the in-memory CacheStore, keeping one RingCache per
+// metric. The text protocol server drives one Processor, and thus one
+// CacheStore, from a goroutine per connection plus one per SUB
+// subscription, so every method locks mu around the underlying
+// RingCache's ring slots and itree -- neither is safe for concurrent
+// use on its own.
+type MemStore struct {
+	mu    sync.Mutex
+	rings map[QueryType]*RingCache
+}
+
+func NewMemStore() *MemStore {
+	m := &MemStore{rings: make(map[QueryType]*RingCache, 6)}
+	for _, qt := range []QueryType{Count, Buys, Sells, Vol, OHLC, VWAP} {
+		m.rings[qt] = newRingCache()
+	}
+	return m
+}
+
+func (m *MemStore) Get(metric QueryType, start, width int64) (Bucket, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rings[metric].rings[resolution(width)].get(start)
+}
+
+func (m *MemStore) Put(metric QueryType, iv interval, b Bucket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rings[metric].Put(iv, b)
+}
+
+func (m *MemStore) Cover(metric QueryType, start, end int64) ([]Bucket, []interval) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rings[metric].Cover(start, end)
+}
+
+func (m *MemStore) Overlapping(metric QueryType, start, end int64) []itree.Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rings[metric].Overlapping(start, end)
+}
+
+func (m *MemStore) Delete(metric QueryType, iv interval) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rings[metric].Delete(iv)
+}
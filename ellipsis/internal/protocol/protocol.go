@@ -0,0 +1,244 @@
+// Package protocol implements a beanstalkd-style line protocol for
+// Processor: each request is "<id> <TYPE> <start> <end>\r\n", answered
+// with "OK <id> <value>\r\n" or "ERR <id> <msg>\r\n" so a client can
+// correlate replies to requests. "BATCH <n>\r\n" pipelines n requests
+// into n correlated replies, and "SUB <id> <TYPE> <start> <end> <step>\r\n"
+// streams "TICK <id> <t> <value>\r\n" lines as the window advances.
+package protocol
+
+import (
+	"bufio"
+	"ellipsis/internal/processor"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves the line protocol over a TCP listener or any
+// io.ReadWriter (e.g. stdio).
+type Server struct {
+	processor *processor.Processor
+	logger    *log.Logger
+}
+
+type Opts struct {
+	Processor *processor.Processor
+	Logger    *log.Logger
+}
+
+func NewServer(opts Opts) *Server {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &Server{processor: opts.Processor, logger: logger}
+}
+
+// ListenAndServe accepts connections on addr, serving each on its own
+// goroutine, until the listener errors or is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	s.Serve(conn)
+}
+
+// Serve runs the protocol over a single stream until its reader side
+// returns EOF. It blocks, so callers on stdio should run it directly;
+// ListenAndServe runs one per accepted connection instead.
+func (s *Server) Serve(rw io.ReadWriter) {
+	r := bufio.NewReader(rw)
+	w := &syncWriter{w: rw}
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Println("read error:", err)
+			}
+			return
+		}
+		if line == "" {
+			continue
+		}
+		s.dispatch(line, r, w)
+	}
+}
+
+// syncWriter serializes writes from the request/reply loop against
+// concurrent TICK lines from subscriptions on the same connection.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s *Server) dispatch(line string, r *bufio.Reader, w io.Writer) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "BATCH":
+		s.handleBatch(fields, r, w)
+	case "SUB":
+		s.handleSub(fields, w)
+	default:
+		s.handleRequest(fields, w)
+	}
+}
+
+// handleBatch reads n more request lines off r and writes n correlated
+// replies, letting a client pipeline a batch of queries in one round
+// trip.
+func (s *Server) handleBatch(fields []string, r *bufio.Reader, w io.Writer) {
+	if len(fields) != 2 {
+		fmt.Fprintf(w, "ERR BATCH invalid batch frame\r\n")
+		return
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		fmt.Fprintf(w, "ERR BATCH invalid batch size: %s\r\n", fields[1])
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			s.logger.Println("batch read error:", err)
+			return
+		}
+		s.handleRequest(strings.Fields(line), w)
+	}
+}
+
+func (s *Server) handleRequest(fields []string, w io.Writer) {
+	id, query, err := parseRequest(fields)
+	if err != nil {
+		writeErr(w, id, err)
+		return
+	}
+
+	result, err := s.processor.Execute(*query)
+	if err != nil {
+		writeErr(w, id, err)
+		return
+	}
+	fmt.Fprintf(w, "OK %s %s\r\n", id, result.Value)
+}
+
+func parseRequest(fields []string) (id string, query *processor.Query, err error) {
+	if len(fields) != 4 {
+		if len(fields) > 0 {
+			id = fields[0]
+		}
+		return id, nil, fmt.Errorf("invalid request with %d fields", len(fields))
+	}
+
+	id = fields[0]
+	qt, err := processor.ParseQueryType(fields[1])
+	if err != nil {
+		return id, nil, err
+	}
+	start, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return id, nil, fmt.Errorf("invalid start timestamp: %s", fields[2])
+	}
+	end, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return id, nil, fmt.Errorf("invalid end timestamp: %s", fields[3])
+	}
+
+	return id, &processor.Query{Type: qt, Start: start, End: end}, nil
+}
+
+func writeErr(w io.Writer, id string, err error) {
+	fmt.Fprintf(w, "ERR %s %s\r\n", id, err)
+}
+
+// handleSub starts a goroutine that streams TICK lines for a
+// "SUB <id> <TYPE> <start> <end> <step>" request.
+func (s *Server) handleSub(fields []string, w io.Writer) {
+	if len(fields) != 6 {
+		fmt.Fprintf(w, "ERR SUB invalid subscribe frame\r\n")
+		return
+	}
+	id := fields[1]
+
+	qt, err := processor.ParseQueryType(fields[2])
+	if err != nil {
+		writeErr(w, id, err)
+		return
+	}
+	start, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		writeErr(w, id, fmt.Errorf("invalid start timestamp: %s", fields[3]))
+		return
+	}
+	end, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		writeErr(w, id, fmt.Errorf("invalid end timestamp: %s", fields[4]))
+		return
+	}
+	step, err := strconv.ParseInt(fields[5], 10, 64)
+	if err != nil || step <= 0 {
+		writeErr(w, id, fmt.Errorf("invalid step: %s", fields[5]))
+		return
+	}
+
+	go s.streamTicks(id, qt, start, end, step, w)
+}
+
+// streamTicks re-runs the query on a window that grows by step every
+// step seconds, writing one TICK line per tick, until the window
+// reaches end or a write fails (the client disconnected).
+func (s *Server) streamTicks(id string, qt processor.QueryType, start, end, step int64, w io.Writer) {
+	ticker := time.NewTicker(time.Duration(step) * time.Second)
+	defer ticker.Stop()
+
+	for t := start + step; t <= end; t += step {
+		<-ticker.C
+
+		result, err := s.processor.Execute(processor.Query{Type: qt, Start: start, End: t})
+		if err != nil {
+			s.logger.Println("sub", id, "error:", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "TICK %s %d %s\r\n", id, t, result.Value); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket: capacity burst tokens refill at rate
+// tokens per second, and acquire blocks until n tokens are available
+// before consuming them.
+type rateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+
+	served    int
+	throttled int
+	waitTotal time.Duration
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:     rate,
+		burst:    burst,
+		tokens:   burst,
+		lastFill: time.Now(),
+	}
+}
+
+// acquire blocks until n tokens are available, then consumes them.
+func (rl *rateLimiter) acquire(n float64) {
+	start := time.Now()
+	throttled := false
+
+	for {
+		rl.mu.Lock()
+		rl.refill(n)
+
+		if rl.tokens >= n {
+			rl.tokens -= n
+			rl.served++
+			if throttled {
+				rl.waitTotal += time.Since(start)
+			}
+			rl.mu.Unlock()
+			return
+		}
+
+		if !throttled {
+			rl.throttled++
+			throttled = true
+		}
+		deficit := n - rl.tokens
+		wait := time.Duration(deficit / rl.rate * float64(time.Second))
+		rl.mu.Unlock()
+
+		time.Sleep(wait)
+	}
+}
+
+// refill adds tokens for the time elapsed since the last refill, capping
+// at whichever is larger of rl.burst and n. Capping at a plain rl.burst
+// would mean a single request costing more than burst could never
+// accumulate enough tokens to be served -- acquire would spin forever --
+// so the cap widens just enough to let that one request through, and
+// normal bursts are still bounded by rl.burst once it's been paid for.
+// Callers must hold rl.mu.
+func (rl *rateLimiter) refill(n float64) {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.lastFill).Seconds() * rl.rate
+
+	cap := rl.burst
+	if n > cap {
+		cap = n
+	}
+	if rl.tokens > cap {
+		rl.tokens = cap
+	}
+	rl.lastFill = now
+}
+
+// Stats reports how many calls the limiter has let through and how many
+// of those had to wait for tokens, plus their average wait.
+type Stats struct {
+	Served    int
+	Throttled int
+	AvgWait   time.Duration
+}
+
+func (rl *rateLimiter) stats() Stats {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var avgWait time.Duration
+	if rl.throttled > 0 {
+		avgWait = rl.waitTotal / time.Duration(rl.throttled)
+	}
+	return Stats{Served: rl.served, Throttled: rl.throttled, AvgWait: avgWait}
+}
@@ -12,6 +12,12 @@ import (
 const (
 	dateFmt        = "2006-01-02 15:04:05"
 	approxSecToDay = 0.00001 // 1s is approximately 0.00001 (1.15741e-5) days
+
+	// defaultRPS and defaultBurst give GetFillsAPI headroom for a
+	// handful of concurrent day-sized queries before it starts
+	// throttling callers.
+	defaultRPS   = 2.0
+	defaultBurst = 5.0
 )
 
 type Fill struct {
@@ -23,10 +29,21 @@ type Fill struct {
 }
 
 type Server struct {
-	fills []*Fill
+	fills   []*Fill
+	limiter *rateLimiter
+}
+
+// Opts configures the token-bucket rate limiter guarding GetFillsAPI.
+// RPS and Burst are in units of "seconds of GetFillsAPI work per
+// second of wall time" -- the same units as the sleepTime it simulates
+// -- so an RPS of 2 lets callers sustain the equivalent of 2 one-day
+// queries a second, with Burst seconds of slack on top.
+type Opts struct {
+	RPS   float64
+	Burst float64
 }
 
-func NewServer() *Server {
+func NewServer(opts Opts) *Server {
 	file := must(os.Open("./trades.csv"))
 	defer file.Close()
 	records := must(csv.NewReader(file).ReadAll())
@@ -44,8 +61,18 @@ func NewServer() *Server {
 		fills = append(fills, fill)
 	}
 
+	rps := opts.RPS
+	if rps <= 0 {
+		rps = defaultRPS
+	}
+	burst := opts.Burst
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+
 	return &Server{
-		fills: fills,
+		fills:   fills,
+		limiter: newRateLimiter(rps, burst),
 	}
 }
 
@@ -56,6 +83,9 @@ func (s *Server) GetFillsAPI(startTsInSeconds int64, endTsInSeconds int64) []*Fi
 	// fetching 1 day's worth of data should take around 1s (0.864s)
 	intervalLen := float64(endTsInSeconds - startTsInSeconds)
 	sleepTime := time.Duration(intervalLen * float64(time.Second) * approxSecToDay)
+
+	// an interval twice as expensive to serve costs twice the tokens
+	s.limiter.acquire(intervalLen * approxSecToDay)
 	time.Sleep(sleepTime)
 
 	var result []*Fill
@@ -68,6 +98,13 @@ func (s *Server) GetFillsAPI(startTsInSeconds int64, endTsInSeconds int64) []*Fi
 	return result
 }
 
+// Stats returns how many GetFillsAPI calls the rate limiter has served,
+// how many of those were throttled first, and the average wait among
+// throttled calls.
+func (s *Server) Stats() Stats {
+	return s.limiter.stats()
+}
+
 func must[T any](ret T, err error) T {
 	if err != nil {
 		panic(err)